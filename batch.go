@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ECSTagDB is a fleet tag that can target any number of hosts, via
+// ECSHostTagDB.
+type ECSTagDB struct {
+	gorm.Model
+	Tagname string `gorm:"uniqueIndex"`
+}
+
+// ECSHostTagDB maps a tag to one of the hosts it targets. A host may carry
+// several tags and a tag may cover several hosts.
+type ECSHostTagDB struct {
+	gorm.Model
+	TagID    uint   `gorm:"uniqueIndex:idx_host_tag,not null"`
+	Hostname string `gorm:"uniqueIndex:idx_host_tag,not null"`
+}
+
+// resolveTagHostnames returns every hostname tagged with tagname.
+func resolveTagHostnames(tagname string) ([]string, error) {
+	var ecsTagDB ECSTagDB
+	if result := db.Where("tagname = ?", tagname).First(&ecsTagDB); errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, errors.New("tagname not found")
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+
+	var hostTags []ECSHostTagDB
+	if res := db.Where("tag_id = ?", ecsTagDB.ID).Find(&hostTags); res.Error != nil {
+		return nil, res.Error
+	}
+	if len(hostTags) == 0 {
+		return nil, errors.New("tag has no hosts")
+	}
+
+	hostnames := make([]string, 0, len(hostTags))
+	for _, ht := range hostTags {
+		hostnames = append(hostnames, ht.Hostname)
+	}
+	return hostnames, nil
+}
+
+// createBatch inserts one CmdDB row per hostname, all sharing a fresh
+// BatchID, and kicks off a scheduler that releases them for dispatch
+// parallelism-at-a-time. A parallelism of 0 means "no limit": every job is
+// dispatched immediately.
+func createBatch(shell string, hostnames []string, parallelism int, timeout int) (uuid.UUID, []string, error) {
+	batchID := uuid.New()
+
+	jobs := make([]CmdDB, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		jobs = append(jobs, CmdDB{Shell: shell, State: jobStateToSchedule, Hostname: hostname, BatchID: batchID, Timeout: timeout})
+	}
+	if res := db.Create(&jobs); res.Error != nil {
+		return uuid.UUID{}, nil, res.Error
+	}
+
+	if parallelism <= 0 || parallelism > len(jobs) {
+		parallelism = len(jobs)
+	}
+	go runBatchScheduler(jobs, parallelism)
+
+	targets := make([]string, len(jobs))
+	for i, job := range jobs {
+		targets[i] = job.Hostname
+	}
+	return batchID, targets, nil
+}
+
+// batchJobPollInterval is how often watchJobCompletion double-checks a
+// dispatched job's DB state, as a fallback for completions the log broker
+// sentinel might miss.
+const batchJobPollInterval = 2 * time.Second
+
+// batchJobMaxWait bounds how long the scheduler waits on any single job
+// before giving up on it and releasing the next one anyway, so a job stuck
+// on an offline or unresponsive agent can't stall the rest of the batch
+// forever.
+const batchJobMaxWait = 10 * time.Minute
+
+// runBatchScheduler keeps at most parallelism jobs of the batch dispatched
+// at once, releasing the next queued job as soon as an in-flight one
+// finishes (or is given up on). Completion is primarily observed via the log
+// broker's end-of-logs sentinel, which RecordJobResult/cancelJob/timeoutJob
+// publish, with a DB-state poll and a max-wait giveup as fallbacks.
+func runBatchScheduler(jobs []CmdDB, parallelism int) {
+	// Buffered to len(jobs): every watchJobCompletion goroutine sends
+	// exactly once, but the scheduler only ever receives len(jobs) -
+	// parallelism times (the last parallelism releases have no matching
+	// <-done). An unbuffered channel would leave those goroutines blocked
+	// on the send forever, leaking them and their logBroker subscriptions.
+	done := make(chan struct{}, len(jobs))
+	next := 0
+
+	release := func() {
+		job := &jobs[next]
+		// Subscribe before dispatching, not after: a job can finish (and
+		// publish its sentinel) between the two, and a subscribe that
+		// happens afterward would miss it and wait forever.
+		sub, cancel := logBroker.Subscribe(job.ID)
+		go watchJobCompletion(job.ID, sub, cancel, done)
+		dispatchBatchJob(job)
+		next++
+	}
+
+	for next < parallelism {
+		release()
+	}
+	for next < len(jobs) {
+		<-done
+		release()
+	}
+}
+
+// dispatchBatchJob marks a job dispatched and pushes it to its agent. Send
+// silently drops the frame if the target host isn't currently connected;
+// watchJobCompletion's poll/giveup fallbacks are what keep the batch moving
+// in that case.
+func dispatchBatchJob(job *CmdDB) {
+	if res := db.Model(&CmdDB{}).Where("id = ?", job.ID).Update("dispatched", true); res.Error != nil {
+		log.Println(res.Error)
+	}
+	connRegistry.Send(job.Hostname, envelopeTypeCmd, Cmd{ID: job.ID, Context: job.Shell})
+}
+
+// watchJobCompletion waits for cmdID to finish, then signals done so the
+// batch scheduler can release the next queued job. It mainly waits on sub's
+// end-of-logs sentinel, but also polls the job's own DB state in case the
+// sentinel was already missed, and gives up after batchJobMaxWait so an
+// agent that never delivers a result (offline, unreachable, or the job was
+// never actually dispatched) can't stall the rest of the batch.
+func watchJobCompletion(cmdID uint, sub <-chan LogMessage, cancel func(), done chan<- struct{}) {
+	defer cancel()
+
+	ticker := time.NewTicker(batchJobPollInterval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(batchJobMaxWait)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case msg, ok := <-sub:
+			if !ok {
+				done <- struct{}{}
+				return
+			}
+			if msg.EndOfLogs {
+				done <- struct{}{}
+				return
+			}
+		case <-ticker.C:
+			if _, terminal, err := jobTerminalState(cmdID); err != nil {
+				log.Println(err)
+			} else if terminal {
+				done <- struct{}{}
+				return
+			}
+		case <-deadline.C:
+			log.Printf("batch scheduler: giving up waiting on cmd %d after %s, releasing next job", cmdID, batchJobMaxWait)
+			done <- struct{}{}
+			return
+		}
+	}
+}
+
+// BatchTarget is one host's state and result within a batch.
+type BatchTarget struct {
+	Hostname string `json:"hostname"`
+	State    int    `json:"state"`
+	Result   string `json:"result"`
+}
+
+// handleBatchStatus serves GET /batch/:id: per-host state and result, plus
+// rolled-up pending/succeeded/failed/cancelled/timed_out counts.
+func handleBatchStatus(c *gin.Context) {
+	batchID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	var jobs []CmdDB
+	if res := db.Where("batch_id = ?", batchID).Order("id asc").Find(&jobs); res.Error != nil {
+		c.AbortWithError(http.StatusInternalServerError, res.Error)
+		return
+	}
+	if len(jobs) == 0 {
+		c.AbortWithError(http.StatusNotFound, errors.New("batch not found"))
+		return
+	}
+
+	targets := make([]BatchTarget, len(jobs))
+	pending, succeeded, failed, cancelled, timedOut := 0, 0, 0, 0, 0
+	for i, job := range jobs {
+		targets[i] = BatchTarget{Hostname: job.Hostname, State: job.State, Result: job.Result}
+		switch job.State {
+		case jobStateExecSucceeded:
+			succeeded++
+		case jobStateExecFailed:
+			failed++
+		case jobStateCancelled:
+			cancelled++
+		case jobStateTimedOut:
+			timedOut++
+		default:
+			pending++
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"batch_id":  batchID,
+		"pending":   pending,
+		"succeeded": succeeded,
+		"failed":    failed,
+		"cancelled": cancelled,
+		"timed_out": timedOut,
+		"targets":   targets,
+	})
+}
+
+// batchLogLine is one line of batch log output, tagged with the hostname it
+// came from so a client can tell the per-host streams apart.
+type batchLogLine struct {
+	Hostname string `json:"hostname"`
+	LogMessage
+}
+
+// handleBatchLogs serves GET /batch/:id/logs?follow, multiplexing every
+// job's streaming log (see handleCmdLogs) into one websocket, each line
+// prefixed with its hostname.
+func handleBatchLogs(c *gin.Context) {
+	batchID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	var jobs []CmdDB
+	if res := db.Where("batch_id = ?", batchID).Find(&jobs); res.Error != nil {
+		c.AbortWithError(http.StatusInternalServerError, res.Error)
+		return
+	}
+	if len(jobs) == 0 {
+		c.AbortWithError(http.StatusNotFound, errors.New("batch not found"))
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer conn.Close()
+
+	lines := make(chan batchLogLine)
+	// done tells every streamJobLogLines goroutine to give up on sending if
+	// the client disconnects early: without it, a goroutine for a job that's
+	// still running would block on out<- forever once nothing reads lines
+	// anymore, leaking the goroutine and its logBroker subscription.
+	done := make(chan struct{})
+	defer close(done)
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job CmdDB) {
+			defer wg.Done()
+			streamJobLogLines(job, lines, done)
+		}(job)
+	}
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+
+	for line := range lines {
+		if err := conn.WriteJSON(line); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+// streamJobLogLines replays job's persisted log chunks, then forwards new
+// ones as they're published, until its end-of-logs sentinel arrives. If the
+// job had already finished before this call subscribed, that sentinel was
+// published in the past and will never be replayed, so it checks the job's
+// current state after the flush and synthesizes one instead of blocking
+// forever. done lets the caller abandon an in-progress send (e.g. the
+// client disconnected and stopped reading out), so this goroutine and its
+// logBroker subscription don't leak waiting on a send nobody will ever read.
+func streamJobLogLines(job CmdDB, out chan<- batchLogLine, done <-chan struct{}) {
+	sub, cancel := logBroker.Subscribe(job.ID)
+	defer cancel()
+
+	rows, err := queryCmdLogsAfter(job.ID, 0)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	lastSeq := 0
+	for _, row := range rows {
+		row := row
+		select {
+		case out <- batchLogLine{Hostname: job.Hostname, LogMessage: LogMessage{CmdLog: &row}}:
+		case <-done:
+			return
+		}
+		lastSeq = row.Seq
+	}
+
+	if _, terminal, err := jobTerminalState(job.ID); err != nil {
+		log.Println(err)
+		return
+	} else if terminal {
+		select {
+		case out <- batchLogLine{Hostname: job.Hostname, LogMessage: LogMessage{EndOfLogs: true}}:
+		case <-done:
+		}
+		return
+	}
+
+	for msg := range sub {
+		if msg.CmdLog != nil {
+			if msg.Seq <= lastSeq {
+				continue
+			}
+			lastSeq = msg.Seq
+		}
+		select {
+		case out <- batchLogLine{Hostname: job.Hostname, LogMessage: msg}:
+		case <-done:
+			return
+		}
+		if msg.EndOfLogs {
+			return
+		}
+	}
+}
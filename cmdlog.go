@@ -0,0 +1,204 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CmdLog is an incremental chunk of a running command's output, streamed
+// from the agent over the websocket as the shell executes.
+type CmdLog struct {
+	ID        uint      `json:"id"`
+	Seq       int       `json:"seq"`
+	Stdout    string    `json:"stdout"`
+	Stderr    string    `json:"stderr"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CmdLogDB persists each CmdLog chunk so that /cmd/:id/logs can replay
+// history to clients that connect after some output has already happened.
+type CmdLogDB struct {
+	gorm.Model
+	CmdID  uint `gorm:"uniqueIndex:idx_cmd_log,not null"`
+	Seq    int  `gorm:"uniqueIndex:idx_cmd_log,not null"`
+	Stdout string
+	Stderr string
+}
+
+// LogMessage is what the log broker fans out to subscribers: either a
+// CmdLog chunk, or an end-of-logs sentinel once the owning job finishes.
+type LogMessage struct {
+	*CmdLog
+	EndOfLogs bool `json:"end_of_logs,omitempty"`
+}
+
+// LogBroker fans out CmdLog chunks to any number of subscribers of a given
+// cmd ID. It's factored behind an interface so the in-process implementation
+// can later be swapped for a Redis/NATS backed one without touching callers.
+type LogBroker interface {
+	Publish(cmdID uint, msg LogMessage)
+	Subscribe(cmdID uint) (ch <-chan LogMessage, cancel func())
+}
+
+type inProcessLogBroker struct {
+	mu   sync.RWMutex
+	subs map[uint][]chan LogMessage
+}
+
+func newInProcessLogBroker() *inProcessLogBroker {
+	return &inProcessLogBroker{subs: make(map[uint][]chan LogMessage)}
+}
+
+func (b *inProcessLogBroker) Subscribe(cmdID uint) (<-chan LogMessage, func()) {
+	ch := make(chan LogMessage, 16)
+
+	b.mu.Lock()
+	b.subs[cmdID] = append(b.subs[cmdID], ch)
+	b.mu.Unlock()
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		subs := b.subs[cmdID]
+		for i, c := range subs {
+			if c == ch {
+				b.subs[cmdID] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+		if len(b.subs[cmdID]) == 0 {
+			delete(b.subs, cmdID)
+		}
+		close(ch)
+	}
+	return ch, cancel
+}
+
+func (b *inProcessLogBroker) Publish(cmdID uint, msg LogMessage) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, ch := range b.subs[cmdID] {
+		select {
+		case ch <- msg:
+		default:
+			log.Printf("log broker: dropping message for cmd %d, subscriber buffer full", cmdID)
+		}
+	}
+}
+
+var logBroker LogBroker = newInProcessLogBroker()
+
+// recordCmdLog persists an agent-reported output chunk and fans it out to
+// anyone following the job's logs.
+func recordCmdLog(entry *CmdLog) error {
+	row := CmdLogDB{CmdID: entry.ID, Seq: entry.Seq, Stdout: entry.Stdout, Stderr: entry.Stderr}
+	if !entry.CreatedAt.IsZero() {
+		row.CreatedAt = entry.CreatedAt
+	}
+	if res := db.Create(&row); res.Error != nil {
+		return res.Error
+	}
+	logBroker.Publish(entry.ID, LogMessage{CmdLog: entry})
+	return nil
+}
+
+// queryCmdLogsAfter returns persisted log chunks for cmdID with seq > after,
+// ordered oldest first.
+func queryCmdLogsAfter(cmdID uint, after int) ([]CmdLog, error) {
+	var rows []CmdLogDB
+	if res := db.Where("cmd_id = ? and seq > ?", cmdID, after).Order("seq asc").Find(&rows); res.Error != nil {
+		return nil, res.Error
+	}
+	logs := make([]CmdLog, 0, len(rows))
+	for _, r := range rows {
+		logs = append(logs, CmdLog{ID: r.CmdID, Seq: r.Seq, Stdout: r.Stdout, Stderr: r.Stderr, CreatedAt: r.CreatedAt})
+	}
+	return logs, nil
+}
+
+// handleCmdLogs serves GET /cmd/:id/logs?after=<seq>&follow. Without follow
+// it's a plain JSON replay of everything after the given seq. With follow it
+// upgrades to a websocket: it subscribes to the log broker first, then
+// flushes rows already in the DB, then streams new chunks as they arrive,
+// deduping anything the subscription delivers that the DB flush already
+// covered. It exits once the job's end-of-logs sentinel is published, or
+// immediately after the flush if the job had already finished before this
+// request connected — the real sentinel was published in the past, so
+// waiting on the subscription for it would block forever.
+func handleCmdLogs(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	cmdID := uint(id)
+
+	after, _ := strconv.Atoi(c.Query("after"))
+	if _, follow := c.GetQuery("follow"); !follow {
+		rows, err := queryCmdLogsAfter(cmdID, after)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, rows)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer conn.Close()
+
+	// Subscribe before querying the DB so a chunk published in the gap
+	// between the query and the subscribe call is never lost.
+	sub, cancel := logBroker.Subscribe(cmdID)
+	defer cancel()
+
+	rows, err := queryCmdLogsAfter(cmdID, after)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	lastSeq := after
+	for _, row := range rows {
+		if err := conn.WriteJSON(row); err != nil {
+			log.Println(err)
+			return
+		}
+		lastSeq = row.Seq
+	}
+
+	if _, terminal, err := jobTerminalState(cmdID); err != nil {
+		log.Println(err)
+		return
+	} else if terminal {
+		if err := conn.WriteJSON(LogMessage{EndOfLogs: true}); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	for msg := range sub {
+		if msg.CmdLog != nil {
+			if msg.Seq <= lastSeq {
+				continue
+			}
+			lastSeq = msg.Seq
+		}
+		if err := conn.WriteJSON(msg); err != nil {
+			log.Println(err)
+			return
+		}
+		if msg.EndOfLogs {
+			return
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+// Envelope wraps every frame on the agent websocket so that work frames
+// (cmd, cmd_result, cmd_log) and control frames (cancel, and whatever
+// follows it) can share the same connection unambiguously.
+type Envelope struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+const (
+	envelopeTypeCmd       = "cmd"
+	envelopeTypeCmdResult = "cmd_result"
+	envelopeTypeCmdLog    = "cmd_log"
+	envelopeTypeCancel    = "cancel"
+)
+
+// CancelPayload is the payload of a "cancel" control frame.
+type CancelPayload struct {
+	ID uint `json:"id"`
+}
+
+// writeEnvelope marshals payload and writes it to conn wrapped in an
+// Envelope of the given type.
+func writeEnvelope(conn *websocket.Conn, envType string, payload interface{}) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return conn.WriteJSON(Envelope{Type: envType, Payload: raw})
+}
+
+// agentFrame is one decoded message off the agent websocket, produced by
+// handleWebSocket's read goroutine and consumed by its select loop.
+type agentFrame struct {
+	isLog     bool
+	cmdLog    CmdLog
+	cmdResult CmdResult
+	err       error
+}
+
+// readAgentFrame reads one message off the agent websocket and decodes its
+// envelope, returning the CmdLog or CmdResult payload depending on type.
+func readAgentFrame(conn *websocket.Conn) (isLog bool, cmdLog CmdLog, cmdResult CmdResult, err error) {
+	_, raw, err := conn.ReadMessage()
+	if err != nil {
+		return
+	}
+
+	var envelope Envelope
+	if err = json.Unmarshal(raw, &envelope); err != nil {
+		return
+	}
+
+	switch envelope.Type {
+	case envelopeTypeCmdLog:
+		isLog = true
+		err = json.Unmarshal(envelope.Payload, &cmdLog)
+	case envelopeTypeCmdResult:
+		err = json.Unmarshal(envelope.Payload, &cmdResult)
+	default:
+		err = fmt.Errorf("unknown agent frame type %q", envelope.Type)
+	}
+	return
+}
+
+// markDispatched stamps the time the server actually handed cmdID's job to
+// its agent over the websocket, which is what the timeout sweeper measures
+// from.
+func markDispatched(cmdID uint) error {
+	now := time.Now()
+	return db.Model(&CmdDB{}).Where("id = ?", cmdID).Update("dispatched_at", &now).Error
+}
+
+// cancelJob marks job cancelled in the DB and, if the batch scheduler has
+// already released it (Dispatched), sends its agent a cancel control frame.
+// Dispatched is set at release time, before delivery, so this covers every
+// job already handed to an agent, plus released jobs that never arrived.
+func cancelJob(job *CmdDB) error {
+	if res := db.Model(&CmdDB{}).Where("id = ? and state = ?", job.ID, jobStateToSchedule).Update("state", jobStateCancelled); res.Error != nil {
+		return res.Error
+	}
+	if job.Dispatched {
+		connRegistry.Send(job.Hostname, envelopeTypeCancel, CancelPayload{ID: job.ID})
+	}
+	logBroker.Publish(job.ID, LogMessage{EndOfLogs: true})
+	return nil
+}
+
+// timeoutJob is cancelJob's counterpart for the sweeper: same effect, just
+// landing on jobStateTimedOut instead of jobStateCancelled.
+func timeoutJob(job *CmdDB) error {
+	if res := db.Model(&CmdDB{}).Where("id = ? and state = ?", job.ID, jobStateToSchedule).Update("state", jobStateTimedOut); res.Error != nil {
+		return res.Error
+	}
+	connRegistry.Send(job.Hostname, envelopeTypeCancel, CancelPayload{ID: job.ID})
+	logBroker.Publish(job.ID, LogMessage{EndOfLogs: true})
+	return nil
+}
+
+// handleCancelCmd serves DELETE /cmd/:id.
+func handleCancelCmd(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	cmdID := uint(id)
+
+	var job CmdDB
+	if res := db.First(&job, cmdID); errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		c.AbortWithError(http.StatusNotFound, errors.New("cmd not found"))
+		return
+	} else if res.Error != nil {
+		c.AbortWithError(http.StatusInternalServerError, res.Error)
+		return
+	}
+
+	if job.State != jobStateToSchedule {
+		c.AbortWithError(http.StatusConflict, errors.New("cmd already finished"))
+		return
+	}
+
+	if err := cancelJob(&job); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": job.ID, "state": jobStateCancelled})
+}
+
+// runTimeoutSweeper periodically cancels jobs that have been dispatched
+// longer than their Timeout allows.
+func runTimeoutSweeper() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		sweepTimedOutJobs()
+	}
+}
+
+func sweepTimedOutJobs() {
+	// Doesn't also filter on dispatched = true: that flag is set by the
+	// batch scheduler at release time, not at actual delivery, and every
+	// job that gets dispatched_at (via the push path or the reconnect poll
+	// fallback, which only hands out released jobs) already has it set.
+	// dispatched_at is what actually reflects "handed to an agent over the
+	// wire" (see markDispatched), which is what the timeout is measured from.
+	var jobs []CmdDB
+	if res := db.Where("state = ? and timeout > 0 and dispatched_at is not null", jobStateToSchedule).Find(&jobs); res.Error != nil {
+		log.Println(res.Error)
+		return
+	}
+
+	now := time.Now()
+	for _, job := range jobs {
+		if job.DispatchedAt == nil {
+			continue
+		}
+		deadline := job.DispatchedAt.Add(time.Duration(job.Timeout) * time.Second)
+		if now.Before(deadline) {
+			continue
+		}
+		if err := timeoutJob(&job); err != nil {
+			log.Println(err)
+		}
+	}
+}
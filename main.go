@@ -1,13 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
@@ -25,8 +29,9 @@ var (
 	jobStateToSchedule    = 0
 	jobStateExecSucceeded = 1
 	jobStateExecFailed    = 2
+	jobStateCancelled     = 3
+	jobStateTimedOut      = 4
 )
-var OnlineConn = make(map[string]time.Time)
 
 type Cmd struct {
 	ID      uint   `json:"id"`
@@ -42,27 +47,35 @@ type CmdResult struct {
 
 type CmdDB struct {
 	gorm.Model
-	Shell    string `gorm:"not null"`
-	State    int    `gorm:"index:idx_query,not null"`
-	Result   string
-	Hostname string `gorm:"index:idx_query,not null"`
-}
-
-type ECSTagDB struct {
-	gorm.Model
-	Hostname string `gorm:"unique"`
-	Tagname  string `gorm:"unique"`
+	Shell        string `gorm:"not null"`
+	State        int    `gorm:"index:idx_query,not null"`
+	Result       string
+	Hostname     string     `gorm:"index:idx_query,not null"`
+	BatchID      uuid.UUID  `gorm:"type:char(36);index"`
+	Dispatched   bool       `gorm:"not null;default:false"`
+	Timeout      int        `gorm:"not null;default:0"`
+	DispatchedAt *time.Time `gorm:"index"`
 }
 
 type CmdRequest struct {
 	Tagname string `form:"ecs"`
 	Cmd     string `form:"cmd"`
 	Token   string `form:"token"`
+	Timeout int    `form:"timeout"`
 }
 
+// QueryNextJob drains one job the batch scheduler has already released
+// (Dispatched) for hostname but that was never actually delivered
+// (DispatchedAt still null) — e.g. because the agent was offline when the
+// scheduler tried to push it. Dispatched alone can't make that distinction:
+// it's set at release time regardless of whether delivery succeeds, while
+// DispatchedAt is only set once a job is actually handed to an agent over
+// the wire (see markDispatched), so filtering on both together is what
+// keeps this from re-handing out a job that's already in flight on a live
+// connection.
 func QueryNextJob(hostname string) *Cmd {
 	var cmdDB CmdDB
-	if result := db.Where("hostname = ? and state = ?", hostname, jobStateToSchedule).First(&cmdDB); errors.Is(result.Error, gorm.ErrRecordNotFound) {
+	if result := db.Where("hostname = ? and state = ? and dispatched = ? and dispatched_at is null", hostname, jobStateToSchedule, true).First(&cmdDB); errors.Is(result.Error, gorm.ErrRecordNotFound) {
 		return &Cmd{
 			ID: CmdNothingID,
 		}
@@ -73,15 +86,35 @@ func QueryNextJob(hostname string) *Cmd {
 	}
 }
 
+// jobTerminalState reports cmdID's current state, and whether that state is
+// terminal (anything other than jobStateToSchedule). Callers that missed a
+// job's end-of-logs sentinel because it was published before they
+// subscribed can use this to tell the two cases apart.
+func jobTerminalState(cmdID uint) (state int, terminal bool, err error) {
+	var job CmdDB
+	if res := db.Select("state").First(&job, cmdID); res.Error != nil {
+		return 0, false, res.Error
+	}
+	return job.State, job.State != jobStateToSchedule, nil
+}
+
 func RecordJobResult(result *CmdResult) error {
 	state := jobStateExecSucceeded
 	if !result.IsSuccess {
 		state = jobStateExecFailed
 	}
-	if res := db.Model(&CmdDB{}).Where("id = ?", result.ID).Updates(CmdDB{State: state, Result: result.Context}); res.Error != nil {
+	// Only a job still in jobStateToSchedule can be resolved here; this
+	// guards against a late result racing a cancel or a timeout.
+	res := db.Model(&CmdDB{}).Where("id = ? and state = ?", result.ID, jobStateToSchedule).Updates(CmdDB{State: state, Result: result.Context})
+	if res.Error != nil {
 		log.Println(res.Error)
 		return res.Error
 	}
+	if res.RowsAffected == 0 {
+		log.Printf("ignoring late result for cmd %d (already cancelled or timed out)", result.ID)
+		return nil
+	}
+	logBroker.Publish(result.ID, LogMessage{EndOfLogs: true})
 	return nil
 }
 
@@ -92,30 +125,110 @@ func handleWebSocket(c *gin.Context) {
 		return
 	}
 	defer conn.Close()
-	conn.SetPingHandler(func(hostname string) error {
-		OnlineConn[hostname] = time.Now()
+
+	frames := make(chan agentFrame)
+	go func() {
+		defer close(frames)
+		for {
+			isLog, cmdLog, cmdResult, err := readAgentFrame(conn)
+			if err != nil {
+				frames <- agentFrame{err: err}
+				return
+			}
+			frames <- agentFrame{isLog: isLog, cmdLog: cmdLog, cmdResult: cmdResult}
+		}
+	}()
+
+	// The agent identifies itself in every cmd_result frame it sends (cmd_log
+	// frames carry no hostname), so it can only be registered (and given a write channel other subsystems can push to)
+	// once the first frame arrives. hostname itself is only ever touched by
+	// this goroutine; pingHostname is the copy the ping handler reads, since
+	// gorilla invokes it from the read goroutine above, not this one.
+	var hostname string
+	var pingHostname atomic.Value // string
+	var entry *connEntry
+	var writeCh <-chan Envelope
+	// The callback argument is the ping frame's application data, not a
+	// hostname, so the heartbeat has to be keyed off pingHostname instead,
+	// once the agent has identified itself.
+	conn.SetPingHandler(func(string) error {
+		if h, ok := pingHostname.Load().(string); ok {
+			connRegistry.Touch(h)
+		}
 		return nil
 	})
+	defer func() {
+		if entry != nil {
+			connRegistry.Unregister(entry)
+		}
+	}()
 
 	for {
-		var cmdResult CmdResult
-		if err := conn.ReadJSON(&cmdResult); err != nil {
-			log.Println(err)
-			return
-		}
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+			if frame.err != nil {
+				log.Println(frame.err)
+				return
+			}
+
+			// incremental output chunk for a still-running job
+			if frame.isLog {
+				if err := recordCmdLog(&frame.cmdLog); err != nil {
+					log.Println(err)
+				}
+				continue
+			}
 
-		// query todo jobs
-		if cmdResult.ID == CmdNothingID {
-			cmd := QueryNextJob(cmdResult.Hostname)
-			if err := conn.WriteJSON(cmd); err != nil {
+			if hostname == "" {
+				hostname = frame.cmdResult.Hostname
+				pingHostname.Store(hostname)
+				entry = connRegistry.Register(hostname, conn.RemoteAddr().String())
+				writeCh = entry.writeCh
+			}
+
+			// query todo jobs: this is now just the reconnect fallback that
+			// drains anything queued while the agent was offline; new jobs
+			// arrive via the write channel below instead.
+			if frame.cmdResult.ID == CmdNothingID {
+				cmd := QueryNextJob(hostname)
+				if err := writeEnvelope(conn, envelopeTypeCmd, cmd); err != nil {
+					log.Println(err)
+					return
+				}
+				if cmd.ID != CmdNothingID {
+					if err := markDispatched(cmd.ID); err != nil {
+						log.Println(err)
+					}
+				}
+				continue
+			}
+
+			// record job result
+			RecordJobResult(&frame.cmdResult)
+
+		case envelope, ok := <-writeCh:
+			if !ok {
+				// the registry closed our channel: a newer connection for
+				// this hostname has taken over, or the janitor evicted this
+				// one for missing its heartbeats
+				return
+			}
+			if err := conn.WriteJSON(envelope); err != nil {
 				log.Println(err)
 				return
 			}
-			continue
+			if envelope.Type == envelopeTypeCmd {
+				var cmd Cmd
+				if err := json.Unmarshal(envelope.Payload, &cmd); err == nil && cmd.ID != CmdNothingID {
+					if err := markDispatched(cmd.ID); err != nil {
+						log.Println(err)
+					}
+				}
+			}
 		}
-
-		// record job result
-		RecordJobResult(&cmdResult)
 	}
 }
 
@@ -139,7 +252,7 @@ func InitDB() error {
 	}
 
 	// Migrate the schema
-	if err := db.AutoMigrate(&CmdDB{}, &ECSTagDB{}); err != nil {
+	if err := db.AutoMigrate(&CmdDB{}, &ECSTagDB{}, &ECSHostTagDB{}, &CmdLogDB{}); err != nil {
 		return err
 	}
 
@@ -159,38 +272,20 @@ func handleSendCmdDirect(c *gin.Context) {
 		return
 	}
 
-	var ecsTagDB ECSTagDB
-	if result := db.Where("tagname = ?", cmdRequest.Tagname).First(&ecsTagDB); errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		c.AbortWithError(http.StatusBadRequest, errors.New("tagname not found"))
+	hostnames, err := resolveTagHostnames(cmdRequest.Tagname)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
 
-	job := CmdDB{Shell: cmdRequest.Cmd, State: jobStateToSchedule, Hostname: ecsTagDB.Hostname}
-	if res := db.Create(&job); res.Error != nil {
-		c.AbortWithError(http.StatusInternalServerError, res.Error)
-	}
-
-	c.String(http.StatusOK, "get it")
-}
-
-func handleOnlineConn(c *gin.Context) {
-	endTime := time.Now().Add(-30 * time.Second)
-	unactiveConn := []string{}
-
-	for host, connTime := range OnlineConn {
-		if connTime.Before(endTime) {
-			unactiveConn = append(unactiveConn, host)
-		}
-	}
-
-	for _, v := range unactiveConn {
-		delete(OnlineConn, v)
+	parallelism, _ := strconv.Atoi(c.Query("parallelism"))
+	batchID, targets, err := createBatch(cmdRequest.Cmd, hostnames, parallelism, cmdRequest.Timeout)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"count": len(OnlineConn),
-		"list":  OnlineConn,
-	})
+	c.JSON(http.StatusOK, gin.H{"batch_id": batchID, "targets": targets})
 }
 
 func main() {
@@ -203,7 +298,15 @@ func main() {
 	r := gin.Default()
 	r.GET("/ws", handleWebSocket)
 	r.GET("/online", handleOnlineConn)
+	r.GET("/online/:host", handleOnlineConnDetail)
+	r.GET("/events", handleConnEvents)
 	r.POST("/cmd", handleSendCmdDirect)
+	r.DELETE("/cmd/:id", handleCancelCmd)
+	r.GET("/cmd/:id/logs", handleCmdLogs)
+	r.GET("/batch/:id", handleBatchStatus)
+	r.GET("/batch/:id/logs", handleBatchLogs)
 
+	go runTimeoutSweeper()
+	go runConnJanitor()
 	r.Run()
 }
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// connEntry tracks one live agent websocket connection. writeCh is the
+// per-host push channel other subsystems (job dispatch, cancellation) use
+// to reach this connection; handleWebSocket is the only goroutine that ever
+// writes to the underlying websocket, so everyone else must go through it.
+//
+// lastPing is mutable (it is updated on every heartbeat) and must only be
+// read or written while holding the owning ConnRegistry's mu; the other
+// fields are set once in Register and never change. All of them are
+// unexported. Callers that need to
+// read one outside the registry get a ConnInfo snapshot instead (see
+// snapshot), so JSON serialization never touches live state lock-free.
+type connEntry struct {
+	hostname    string
+	remoteAddr  string
+	connectedAt time.Time
+	lastPing    time.Time
+	writeCh     chan Envelope
+}
+
+// ConnInfo is a point-in-time, immutable snapshot of a connEntry, safe to
+// read or serialize without holding the registry's lock.
+type ConnInfo struct {
+	Hostname    string    `json:"hostname"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastPing    time.Time `json:"last_ping"`
+}
+
+// snapshot copies entry's fields into a ConnInfo. Callers must hold at
+// least r.mu's RLock.
+func (e *connEntry) snapshot() ConnInfo {
+	return ConnInfo{
+		Hostname:    e.hostname,
+		RemoteAddr:  e.remoteAddr,
+		ConnectedAt: e.connectedAt,
+		LastPing:    e.lastPing,
+	}
+}
+
+// ConnRegistry is a thread-safe directory of live agent connections, keyed
+// by hostname. It replaces the old plain map[string]time.Time, which was
+// read and written from multiple goroutines (the ping handler and the
+// /online handler) with no synchronization at all.
+type ConnRegistry struct {
+	mu    sync.RWMutex
+	conns map[string]*connEntry
+}
+
+func newConnRegistry() *ConnRegistry {
+	return &ConnRegistry{conns: make(map[string]*connEntry)}
+}
+
+// Register starts tracking a connection for hostname and returns its entry.
+// A still-registered earlier connection for the same host is displaced: its
+// write channel is closed, which handleWebSocket treats as "get off", since
+// a new connection has clearly taken over. The close happens while still
+// holding mu, the same lock Send holds across its own channel send, so the
+// two can never race (see Send).
+func (r *ConnRegistry) Register(hostname, remoteAddr string) *connEntry {
+	now := time.Now()
+	entry := &connEntry{
+		hostname:    hostname,
+		remoteAddr:  remoteAddr,
+		connectedAt: now,
+		lastPing:    now,
+		writeCh:     make(chan Envelope, 16),
+	}
+
+	r.mu.Lock()
+	old := r.conns[hostname]
+	r.conns[hostname] = entry
+	if old != nil {
+		close(old.writeCh)
+	}
+	r.mu.Unlock()
+
+	connEvents.Publish(ConnEvent{Type: "connect", Hostname: hostname, At: now})
+	return entry
+}
+
+// Touch records a heartbeat for hostname. It takes the write lock, not just
+// a read lock, because it mutates lastPing: evictStale reads that field
+// under the write lock too, and a plain RLock here would let the two race
+// on a multi-word time.Time.
+func (r *ConnRegistry) Touch(hostname string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.conns[hostname]; ok {
+		entry.lastPing = time.Now()
+	}
+}
+
+// Unregister stops tracking entry, but only if it's still the current
+// connection for its hostname: a reconnect may already have replaced it, in
+// which case the old goroutine exiting shouldn't clobber the new entry. Like
+// Register, the close happens under mu so it can't race a concurrent Send.
+func (r *ConnRegistry) Unregister(entry *connEntry) {
+	r.mu.Lock()
+	isCurrent := r.conns[entry.hostname] == entry
+	if isCurrent {
+		delete(r.conns, entry.hostname)
+		close(entry.writeCh)
+	}
+	r.mu.Unlock()
+
+	if isCurrent {
+		connEvents.Publish(ConnEvent{Type: "disconnect", Hostname: entry.hostname, At: time.Now()})
+	}
+}
+
+// Get returns a snapshot of the live entry for hostname, if any.
+func (r *ConnRegistry) Get(hostname string) (ConnInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, ok := r.conns[hostname]
+	if !ok {
+		return ConnInfo{}, false
+	}
+	return entry.snapshot(), true
+}
+
+// List returns a snapshot of every live connection.
+func (r *ConnRegistry) List() []ConnInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entries := make([]ConnInfo, 0, len(r.conns))
+	for _, entry := range r.conns {
+		entries = append(entries, entry.snapshot())
+	}
+	return entries
+}
+
+// evictStale drops any connection whose last heartbeat is older than
+// staleAfter, as if it had disconnected on its own. The close happens under
+// mu, same as Register and Unregister, so it can't race a concurrent Send.
+func (r *ConnRegistry) evictStale(staleAfter time.Duration) {
+	cutoff := time.Now().Add(-staleAfter)
+
+	r.mu.Lock()
+	var stale []*connEntry
+	for hostname, entry := range r.conns {
+		if entry.lastPing.Before(cutoff) {
+			stale = append(stale, entry)
+			delete(r.conns, hostname)
+			close(entry.writeCh)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, entry := range stale {
+		connEvents.Publish(ConnEvent{Type: "disconnect", Hostname: entry.hostname, At: time.Now()})
+	}
+}
+
+// Send marshals payload as an envelope of type envType and queues it on
+// hostname's write channel, if that host is currently connected. It's the
+// one delivery path other subsystems use to reach a specific agent.
+//
+// The lookup and the channel send both happen under the same RLock that
+// Register/Unregister/evictStale take as a write Lock before closing a
+// channel, so a Send can never land on a channel that's in the middle of
+// being closed: Lock() can't proceed until this RLock section is done, and
+// a fresh RLock can't start until a pending Lock() (and its close) is done.
+func (r *ConnRegistry) Send(hostname, envType string, payload interface{}) bool {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	envelope := Envelope{Type: envType, Payload: raw}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, ok := r.conns[hostname]
+	if !ok {
+		return false
+	}
+
+	select {
+	case entry.writeCh <- envelope:
+		return true
+	default:
+		log.Printf("conn registry: dropping %s frame for %s, write buffer full", envType, hostname)
+		return false
+	}
+}
+
+var connRegistry = newConnRegistry()
+
+const onlineStaleAfter = 30 * time.Second
+
+// runConnJanitor periodically evicts connections that stopped heartbeating,
+// instead of doing that cleanup inline inside the HTTP handler.
+func runConnJanitor() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		connRegistry.evictStale(onlineStaleAfter)
+	}
+}
+
+// ConnEvent is emitted whenever the registry transitions a host between
+// connected and disconnected.
+type ConnEvent struct {
+	Type     string    `json:"type"`
+	Hostname string    `json:"hostname"`
+	At       time.Time `json:"at"`
+}
+
+type connEventBroker struct {
+	mu   sync.RWMutex
+	subs []chan ConnEvent
+}
+
+func newConnEventBroker() *connEventBroker {
+	return &connEventBroker{}
+}
+
+func (b *connEventBroker) Subscribe() (<-chan ConnEvent, func()) {
+	ch := make(chan ConnEvent, 16)
+
+	b.mu.Lock()
+	b.subs = append(b.subs, ch)
+	b.mu.Unlock()
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for i, c := range b.subs {
+			if c == ch {
+				b.subs = append(b.subs[:i], b.subs[i+1:]...)
+				break
+			}
+		}
+		close(ch)
+	}
+	return ch, cancel
+}
+
+func (b *connEventBroker) Publish(event ConnEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("conn event broker: dropping %s event for %s, subscriber buffer full", event.Type, event.Hostname)
+		}
+	}
+}
+
+var connEvents = newConnEventBroker()
+
+// handleOnlineConn serves GET /online: every currently-connected host.
+func handleOnlineConn(c *gin.Context) {
+	entries := connRegistry.List()
+	c.JSON(http.StatusOK, gin.H{"count": len(entries), "list": entries})
+}
+
+// handleOnlineConnDetail serves GET /online/:host.
+func handleOnlineConnDetail(c *gin.Context) {
+	entry, ok := connRegistry.Get(c.Param("host"))
+	if !ok {
+		c.AbortWithError(http.StatusNotFound, errors.New("host not connected"))
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// handleConnEvents serves GET /events?follow, streaming connect/disconnect
+// transitions over a websocket so dashboards can update without polling.
+func handleConnEvents(c *gin.Context) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer conn.Close()
+
+	sub, cancel := connEvents.Subscribe()
+	defer cancel()
+
+	for event := range sub {
+		if err := conn.WriteJSON(event); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}